@@ -0,0 +1,322 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const awsSTSService = "sts"
+
+// awsSubjectToken builds the subject token for an AWS-sourced
+// CredentialSource: a SigV4-signed AWS STS GetCallerIdentity request,
+// serialized the way sts.googleapis.com expects it, so Google can
+// verify the caller's AWS identity without ever seeing long-lived AWS
+// credentials.
+func awsSubjectToken(ctx context.Context, c CredentialSource, audience string) (string, error) {
+	region, err := awsRegion(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("determining AWS region: %v", err)
+	}
+	creds, err := awsCredentials(ctx, c)
+	if err != nil {
+		return "", fmt.Errorf("determining AWS credentials: %v", err)
+	}
+
+	host := "sts." + region + ".amazonaws.com"
+	body := "Action=GetCallerIdentity&Version=2011-06-15"
+	now := time.Now().UTC()
+
+	headers := map[string]string{
+		"host":       host,
+		"x-amz-date": now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	if audience != "" {
+		// Binds the resulting token to the GCP audience it was minted
+		// for, so it can't be replayed against a different workload
+		// identity pool.
+		headers["x-goog-cloud-target-resource"] = audience
+	}
+
+	authHeader := signAWSRequest(creds, region, "POST", host, "/", body, headers, now)
+	headers["authorization"] = authHeader
+
+	type awsHeader struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hdrs := make([]awsHeader, 0, len(keys))
+	for _, k := range keys {
+		hdrs = append(hdrs, awsHeader{Key: k, Value: headers[k]})
+	}
+
+	reqURL := "https://" + host + "/"
+	subjectReq := struct {
+		URL     string      `json:"url"`
+		Method  string      `json:"method"`
+		Headers []awsHeader `json:"headers"`
+	}{URL: reqURL, Method: "POST", Headers: hdrs}
+
+	b, err := json.Marshal(subjectReq)
+	if err != nil {
+		return "", err
+	}
+	return url.QueryEscape(string(b)), nil
+}
+
+type awsCreds struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentials resolves AWS credentials from the environment
+// (AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN), falling
+// back to the EC2/ECS instance metadata service.
+func awsCredentials(ctx context.Context, c CredentialSource) (awsCreds, error) {
+	if ak := os.Getenv("AWS_ACCESS_KEY_ID"); ak != "" {
+		return awsCreds{
+			AccessKeyID:     ak,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	imdsToken, err := awsIMDSToken(ctx)
+	if err != nil {
+		return awsCreds{}, err
+	}
+	roleURL := c.URL
+	if roleURL == "" {
+		roleURL = "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	}
+	role, err := awsIMDSGet(ctx, roleURL, imdsToken)
+	if err != nil {
+		return awsCreds{}, err
+	}
+	role = strings.TrimSpace(role)
+	credsJSON, err := awsIMDSGet(ctx, roleURL+role, imdsToken)
+	if err != nil {
+		return awsCreds{}, err
+	}
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.Unmarshal([]byte(credsJSON), &creds); err != nil {
+		return awsCreds{}, err
+	}
+	return awsCreds{AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.Token}, nil
+}
+
+// awsRegion resolves the AWS region from the environment or the
+// instance metadata service's placement/region endpoint.
+func awsRegion(ctx context.Context, c CredentialSource) (string, error) {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r, nil
+	}
+	if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r, nil
+	}
+	imdsToken, err := awsIMDSToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	regionURL := c.RegionURL
+	if regionURL == "" {
+		regionURL = "http://169.254.169.254/latest/meta-data/placement/region"
+	}
+	region, err := awsIMDSGet(ctx, regionURL, imdsToken)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(region), nil
+}
+
+// awsIMDSToken fetches an IMDSv2 session token. If the token request
+// fails, as on instances that only support IMDSv1, it returns an empty
+// token and no error, and awsIMDSGet then sends an unauthenticated GET.
+func awsIMDSToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil // fall back to IMDSv1
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func awsIMDSGet(ctx context.Context, rawURL, imdsToken string) (string, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if imdsToken != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", imdsToken)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d trying to fetch %s", res.StatusCode, rawURL)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// signAWSRequest computes the SigV4 "Authorization" header for a
+// request to host, following the algorithm documented at
+// https://docs.aws.amazon.com/general/latest/gr/sigv4-signing-process.html.
+func signAWSRequest(creds awsCreds, region, method, host, canonicalURI, body string, headers map[string]string, now time.Time) string {
+	amzDate := headers["x-amz-date"]
+	dateStamp := now.Format("20060102")
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var canonicalHeaders bytes.Buffer
+	for _, k := range keys {
+		canonicalHeaders.WriteString(k)
+		canonicalHeaders.WriteByte(':')
+		canonicalHeaders.WriteString(headers[k])
+		canonicalHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(keys, ";")
+
+	payloadHash := sha256Hex(body)
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		"", // no query string; GetCallerIdentity parameters are in the body
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := dateStamp + "/" + region + "/" + awsSTSService + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	signingKey := awsSigningKey(creds.SecretAccessKey, dateStamp, region, awsSTSService)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, credentialScope, signedHeaders, signature)
+}
+
+func awsSigningKey(secretKey, dateStamp, region, service string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secretKey), dateStamp)
+	kRegion := hmacSHA256(kDate, region)
+	kService := hmacSHA256(kRegion, service)
+	return hmacSHA256(kService, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// runExecutableCredential runs an ExecutableCredentialSource's command
+// and reads the subject token from its stdout, which is either the
+// bare token or a JSON object with a "token_type" field (in which case
+// the token lives in "id_token" or "access_token", matching the
+// executable-sourced credential format other Google client libraries
+// use).
+func runExecutableCredential(ctx context.Context, e ExecutableCredentialSource) (string, error) {
+	fields := strings.Fields(e.Command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("executable: empty command")
+	}
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running %q: %v", e.Command, err)
+	}
+
+	var resp struct {
+		TokenType   string `json:"token_type"`
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+		Success     *bool  `json:"success"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+	if resp.Success != nil && !*resp.Success {
+		return "", fmt.Errorf("executable %q reported failure", e.Command)
+	}
+	if resp.IDToken != "" {
+		return resp.IDToken, nil
+	}
+	if resp.AccessToken != "" {
+		return resp.AccessToken, nil
+	}
+	return strings.TrimSpace(string(out)), nil
+}
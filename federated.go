@@ -0,0 +1,272 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	federatedGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	federatedTokenType = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// FederationConfig describes how to obtain Google access tokens for a
+// workload that isn't running on GCE, by exchanging an external
+// credential for a Google one. Its fields mirror the standard
+// "external_account" credential JSON file layout used across Google's
+// client libraries, so a FederationConfig can be populated directly by
+// unmarshaling that file.
+type FederationConfig struct {
+	Audience                       string           `json:"audience"`
+	SubjectTokenType               string           `json:"subject_token_type"`
+	TokenURL                       string           `json:"token_url"`
+	CredentialSource               CredentialSource `json:"credential_source"`
+	ServiceAccountImpersonationURL string           `json:"service_account_impersonation_url,omitempty"`
+}
+
+// CredentialSource describes where to obtain the external subject
+// token that gets exchanged for a Google access token. Exactly one of
+// File, URL, Executable, or EnvironmentID should be set, except that an
+// AWS source (EnvironmentID) may also set URL, as described below.
+type CredentialSource struct {
+	// File holds a path to a file containing the subject token (e.g.
+	// an OIDC JWT written by the platform, such as a Kubernetes
+	// projected service account token).
+	File string `json:"file,omitempty"`
+
+	// URL and Headers describe an HTTP GET that returns the subject
+	// token, e.g. a GitHub Actions OIDC token endpoint.
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Executable describes a local binary that prints the subject
+	// token (or a structured response containing it) to stdout.
+	Executable *ExecutableCredentialSource `json:"executable,omitempty"`
+
+	// EnvironmentID identifies an AWS-style credential source, e.g.
+	// "aws1". When set, the subject token is a signed AWS
+	// GetCallerIdentity request rather than a bearer token, URL (if
+	// set) overrides the AWS IMDS security-credentials endpoint, and
+	// RegionURL overrides the IMDS region endpoint.
+	EnvironmentID         string `json:"environment_id,omitempty"`
+	RegionURL             string `json:"region_url,omitempty"`
+	RegionalCredVerifyURL string `json:"regional_cred_verification_url,omitempty"`
+}
+
+// ExecutableCredentialSource runs Command and reads the subject token
+// from its stdout.
+type ExecutableCredentialSource struct {
+	Command string
+	Timeout time.Duration
+}
+
+// UnmarshalJSON implements the standard external-account file layout,
+// where the timeout is an integer count of milliseconds rather than a
+// time.Duration's nanoseconds.
+func (e *ExecutableCredentialSource) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Command       string `json:"command"`
+		TimeoutMillis int64  `json:"timeout_millis"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	e.Command = raw.Command
+	e.Timeout = time.Duration(raw.TimeoutMillis) * time.Millisecond
+	return nil
+}
+
+// NewFederatedTokenSource returns a transport that authenticates
+// requests with a Google access token obtained via Workload Identity
+// Federation: it exchanges the external credential described by cfg
+// for a Google token at cfg.TokenURL (typically
+// sts.googleapis.com/v1/token) and, if
+// cfg.ServiceAccountImpersonationURL is set, uses that token to
+// impersonate a Google service account. The result is a drop-in
+// replacement for Transport, so the same Client works unmodified on
+// EKS, AKS, GitHub Actions, or on-prem, without a service-account key.
+func NewFederatedTokenSource(cfg FederationConfig) http.RoundTripper {
+	t := &federatedTransport{cfg: cfg, base: http.DefaultTransport}
+	t.cache = newTokenCache(defaultRefreshAhead, t.fetchToken)
+	return t
+}
+
+type federatedTransport struct {
+	cfg   FederationConfig
+	base  http.RoundTripper
+	cache *tokenCache
+}
+
+func (t *federatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.cache.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// fetchToken implements tokenRefresher: it fetches the subject token
+// from cfg.CredentialSource, exchanges it for a Google access token at
+// cfg.TokenURL, and, if configured, impersonates a service account.
+func (t *federatedTransport) fetchToken(ctx context.Context) (token string, issued, expires time.Time, err error) {
+	subjectToken, err := t.cfg.CredentialSource.subjectToken(ctx, t.cfg.Audience)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("fetching subject token: %v", err)
+	}
+	stsToken, expiresIn, err := exchangeToken(ctx, t.cfg, subjectToken)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("exchanging token at %s: %v", t.cfg.TokenURL, err)
+	}
+	issued = time.Now()
+	if t.cfg.ServiceAccountImpersonationURL == "" {
+		return stsToken, issued, issued.Add(time.Duration(expiresIn) * time.Second), nil
+	}
+	impToken, impExpiry, err := impersonate(ctx, t.cfg.ServiceAccountImpersonationURL, stsToken)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("impersonating service account: %v", err)
+	}
+	return impToken, issued, impExpiry, nil
+}
+
+// subjectToken resolves the external credential named by a
+// CredentialSource. audience is threaded through to AWS-sourced
+// credentials, which bind the resulting token to it.
+func (c CredentialSource) subjectToken(ctx context.Context, audience string) (string, error) {
+	switch {
+	case c.EnvironmentID != "":
+		return awsSubjectToken(ctx, c, audience)
+	case c.File != "":
+		b, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case c.URL != "":
+		return fetchSubjectTokenURL(ctx, c.URL, c.Headers)
+	case c.Executable != nil:
+		return runExecutableCredential(ctx, *c.Executable)
+	default:
+		return "", fmt.Errorf("credential_source: no file, url, executable, or environment_id set")
+	}
+}
+
+func fetchSubjectTokenURL(ctx context.Context, rawURL string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code %d trying to fetch %s", res.StatusCode, rawURL)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// exchangeToken trades subjectToken for a Google access token at
+// cfg.TokenURL using the OAuth 2.0 token-exchange grant (RFC 8693).
+func exchangeToken(ctx context.Context, cfg FederationConfig, subjectToken string) (accessToken string, expiresIn int, err error) {
+	form := url.Values{
+		"grant_type":           {federatedGrantType},
+		"audience":             {cfg.Audience},
+		"scope":                {"https://www.googleapis.com/auth/cloud-platform"},
+		"requested_token_type": {federatedTokenType},
+		"subject_token_type":   {cfg.SubjectTokenType},
+		"subject_token":        {subjectToken},
+	}
+	req, err := http.NewRequest("POST", cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return "", 0, fmt.Errorf("status code %d: %s", res.StatusCode, b)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	if body.AccessToken == "" {
+		return "", 0, fmt.Errorf("no access_token in token exchange response")
+	}
+	return body.AccessToken, body.ExpiresIn, nil
+}
+
+// impersonate calls the IAM Credentials API to mint a short-lived
+// access token for the service account named by impersonationURL,
+// authenticated with sourceToken.
+func impersonate(ctx context.Context, impersonationURL, sourceToken string) (accessToken string, expires time.Time, err error) {
+	reqBody, err := json.Marshal(struct {
+		Scope []string `json:"scope"`
+	}{Scope: []string{"https://www.googleapis.com/auth/cloud-platform"}})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest("POST", impersonationURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+sourceToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return "", time.Time{}, fmt.Errorf("status code %d: %s", res.StatusCode, b)
+	}
+	var body struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", time.Time{}, err
+	}
+	expires, err = time.Parse(time.RFC3339, body.ExpireTime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return body.AccessToken, expires, nil
+}
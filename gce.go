@@ -13,25 +13,83 @@ https://code.google.com/p/go/source/browse/LICENSE
 package gce
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// metadataHostEnv is the environment variable specifying the
+	// GCE metadata hostname. If empty, the default value of
+	// metadataDefaultHost is used instead.
+	metadataHostEnv = "GCE_METADATA_HOST"
+
+	metadataDefaultHost = "metadata"
+	metadataIP          = "169.254.169.254"
+)
+
 var (
 	projOnce sync.Once
 	proj     string
+
+	hostOnce sync.Once
+	host     string
+
+	onGCEOnce sync.Once
+	onGCE     bool
 )
 
 // OnGCE reports whether this process is running on Google Compute Engine.
 func OnGCE() bool {
-	// TODO: maybe something cheaper? this is pretty cheap, though.
-	return ProjectID() != ""
+	onGCEOnce.Do(func() {
+		onGCE = probeMetadata()
+	})
+	return onGCE
+}
+
+// probeMetadata does a fast, short-timeout GET against the root of the
+// metadata service and checks for the Metadata-Flavor response header,
+// which only the metadata service sets. This is much cheaper than the
+// old trick of fetching the project ID, which could take many seconds
+// to time out off of GCE.
+func probeMetadata() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", "http://"+metadataHost()+"/", nil)
+	if err != nil {
+		return false
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	return res.Header.Get("Metadata-Flavor") == "Google"
+}
+
+// metadataHost returns the host (and optional port) to use when talking
+// to the metadata service. It honors the GCE_METADATA_HOST environment
+// variable and otherwise falls back to the documented link-local IP,
+// 169.254.169.254, if the "metadata" DNS name doesn't resolve, which is
+// the case on most non-GCE machines.
+func metadataHost() string {
+	hostOnce.Do(func() {
+		if h := os.Getenv(metadataHostEnv); h != "" {
+			host = h
+			return
+		}
+		host = metadataDefaultHost
+		if _, err := net.LookupHost(host); err != nil {
+			host = metadataIP
+		}
+	})
+	return host
 }
 
 // ProjectID returns the current instance's project ID string or the empty string
@@ -53,73 +111,90 @@ var Transport = NewTransport("default", http.DefaultTransport)
 // Client is an http Client that uses the default GCE transport.
 var Client = &http.Client{Transport: Transport}
 
+// defaultRefreshAhead is the fraction of a token's lifetime, counting
+// down from expiry, at which a background refresh is started so that
+// in-flight callers never block on token acquisition.
+const defaultRefreshAhead = 0.1
+
+// TransportOption configures optional behavior of a transport created
+// by NewTransport.
+type TransportOption func(*transport)
+
+// WithRetryConfig overrides the retry policy used for this transport's
+// token fetches. The default matches MetadataValue's.
+func WithRetryConfig(retry RetryConfig) TransportOption {
+	return func(t *transport) { t.retry = retry }
+}
+
+// WithRefreshAhead overrides the fraction of a token's lifetime,
+// counting down from expiry, at which a background refresh is started. frac must be in
+// (0, 1); the default is 0.1 (refresh with 10% of the TTL left).
+func WithRefreshAhead(frac float64) TransportOption {
+	return func(t *transport) { t.cache.refreshAhead = frac }
+}
+
 // NewTransport returns a transport that uses the provided GCE
 // serviceAccount (optional) to add authentication headers and then
 // uses the provided underlying "base" transport.
-func NewTransport(serviceAccount string, base http.RoundTripper) http.RoundTripper {
+func NewTransport(serviceAccount string, base http.RoundTripper, opts ...TransportOption) http.RoundTripper {
 	if serviceAccount == "" {
 		serviceAccount = "default"
 	}
-	return &transport{base: base, acct: serviceAccount}
+	t := &transport{base: base, acct: serviceAccount, retry: defaultRetryConfig}
+	t.cache = newTokenCache(defaultRefreshAhead, t.fetchToken)
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
 type transport struct {
-	base http.RoundTripper
-	acct string
-
-	mu      sync.Mutex
-	token   string
-	expires time.Time
+	base  http.RoundTripper
+	acct  string
+	retry RetryConfig
+	cache *tokenCache
 }
 
 // MetadataValue returns a value from the metadata service.
-// The suffix is appended to "http://metadata/computeMetadata/v1/".
+// The suffix is appended to "http://<host>/computeMetadata/v1/", where
+// <host> is resolved by metadataHost: it honors the GCE_METADATA_HOST
+// environment variable and otherwise falls back to 169.254.169.254 if
+// the "metadata" DNS name doesn't resolve.
 func MetadataValue(suffix string) (string, error) {
-	url := "http://metadata/computeMetadata/v1/" + suffix
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Metadata-Flavor", "Google")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("status code %d trying to fetch %s", res.StatusCode, url)
-	}
-	all, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return "", err
-	}
-	return string(all), nil
+	return MetadataValueContext(context.Background(), suffix)
 }
 
-func (t *transport) getToken() (string, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.token != "" && t.expires.After(time.Now().Add(2*time.Second)) {
-		return t.token, nil
-	}
-	tokenJSON, err := MetadataValue("instance/service-accounts/" + t.acct + "/token")
+// MetadataValueContext is like MetadataValue but bounds the request to
+// ctx, so callers can apply a deadline or cancel an in-flight metadata
+// fetch. Transient failures (connection errors and 500/502/503/504
+// responses) are retried with exponential backoff.
+func MetadataValueContext(ctx context.Context, suffix string) (string, error) {
+	return fetchMetadata(ctx, suffix, defaultRetryConfig)
+}
+
+// fetchToken implements tokenRefresher by fetching and parsing a fresh
+// access token for t.acct from the metadata service.
+func (t *transport) fetchToken(ctx context.Context) (token string, issued, expires time.Time, err error) {
+	tokenJSON, err := fetchMetadata(ctx, "instance/service-accounts/"+t.acct+"/token", t.retry)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, time.Time{}, err
 	}
-	var token struct {
+	var tok struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   int    `json:"expires_in"`
 	}
-	if err := json.NewDecoder(strings.NewReader(tokenJSON)).Decode(&token); err != nil {
-		return "", err
+	if err := json.NewDecoder(strings.NewReader(tokenJSON)).Decode(&tok); err != nil {
+		return "", time.Time{}, time.Time{}, err
 	}
-	if token.AccessToken == "" {
-		return "", errors.New("no access token returned")
+	if tok.AccessToken == "" {
+		return "", time.Time{}, time.Time{}, errors.New("no access token returned")
 	}
-	t.token = token.AccessToken
-	t.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
-	return t.token, nil
+	issued = time.Now()
+	return tok.AccessToken, issued, issued.Add(time.Duration(tok.ExpiresIn) * time.Second), nil
 }
 
 func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	token, err := t.getToken()
+	token, err := t.cache.get(req.Context())
 	if err != nil {
 		return nil, err
 	}
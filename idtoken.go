@@ -0,0 +1,123 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idTokenExpiryMargin is how far before its exp claim a cached ID
+// token is considered stale, so a refresh has time to complete before
+// a caller would otherwise be handed an expired token.
+const idTokenExpiryMargin = 2 * time.Minute
+
+var (
+	idTokenTransportsMu sync.Mutex
+	idTokenTransports   = map[string]*idTokenTransport{}
+)
+
+// IDToken returns a Google-signed OIDC identity token for the default
+// service account with the given audience, such as the URL of a Cloud
+// Run service or an IAP-protected endpoint. The token is cached until
+// shortly before it expires.
+func IDToken(ctx context.Context, audience string) (string, error) {
+	return getIDTokenTransport("default", audience).cache.get(ctx)
+}
+
+// IDTokenTransport returns a transport that authenticates requests
+// with a Google-signed OIDC identity token for the given audience and
+// serviceAccount (optional), instead of an OAuth2 access token. Use it
+// to call Cloud Run services, IAP-protected endpoints, or any other
+// service that verifies Google-issued ID tokens, which reject the
+// OAuth2 tokens Transport produces.
+func IDTokenTransport(audience, serviceAccount string) http.RoundTripper {
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return getIDTokenTransport(serviceAccount, audience)
+}
+
+func getIDTokenTransport(serviceAccount, audience string) *idTokenTransport {
+	key := serviceAccount + "|" + audience
+	idTokenTransportsMu.Lock()
+	defer idTokenTransportsMu.Unlock()
+	t, ok := idTokenTransports[key]
+	if !ok {
+		t = &idTokenTransport{base: http.DefaultTransport, acct: serviceAccount, audience: audience, retry: defaultRetryConfig}
+		// No refresh-ahead window: a stale ID token is simply refetched
+		// the next time it's needed, per fetchToken's exp-derived expiry.
+		t.cache = newTokenCache(0, t.fetchToken)
+		idTokenTransports[key] = t
+	}
+	return t
+}
+
+type idTokenTransport struct {
+	base     http.RoundTripper
+	acct     string
+	audience string
+	retry    RetryConfig
+	cache    *tokenCache
+}
+
+func (t *idTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.cache.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// fetchToken implements tokenRefresher by fetching an ID token from
+// the metadata service and deriving its cache lifetime from the exp
+// claim in its payload, rather than from any metadata response header.
+func (t *idTokenTransport) fetchToken(ctx context.Context) (token string, issued, expires time.Time, err error) {
+	suffix := fmt.Sprintf("instance/service-accounts/%s/identity?audience=%s&format=full", t.acct, url.QueryEscape(t.audience))
+	idToken, err := fetchMetadata(ctx, suffix, t.retry)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	exp, err := jwtExpiry(idToken)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	return idToken, time.Now(), exp.Add(-idTokenExpiryMargin), nil
+}
+
+// jwtExpiry reads the exp claim out of a JWT's payload without
+// verifying its signature; the metadata service is trusted to have
+// signed it correctly, so all we need here is the expiry.
+func jwtExpiry(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("malformed JWT: expected 3 parts, got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decoding JWT payload: %v", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("parsing JWT payload: %v", err)
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
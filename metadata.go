@@ -0,0 +1,159 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// cachedValue fetches a single metadata suffix at most once per
+// process and remembers the result. It's only appropriate for values
+// that can't change for the lifetime of the instance, such as the
+// project ID, zone, or instance ID.
+type cachedValue struct {
+	k    string // metadata suffix, e.g. "instance/id"
+	trim bool   // whether to strip surrounding whitespace
+
+	mu sync.Mutex
+	v  string
+}
+
+func (c *cachedValue) get() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.v != "" {
+		return c.v, nil
+	}
+	val, err := MetadataValue(c.k)
+	if err != nil {
+		return "", err
+	}
+	if c.trim {
+		val = strings.TrimSpace(val)
+	}
+	c.v = val
+	return c.v, nil
+}
+
+var (
+	instID        = &cachedValue{k: "instance/id", trim: true}
+	instName      = &cachedValue{k: "instance/name", trim: true}
+	instHostname  = &cachedValue{k: "instance/hostname", trim: true}
+	instZone      = &cachedValue{k: "instance/zone", trim: true}
+	numericProjID = &cachedValue{k: "project/numeric-project-id", trim: true}
+)
+
+// InstanceID returns the current instance's numeric ID, which is
+// guaranteed to be unique across all instances in a project.
+func InstanceID() (string, error) {
+	return instID.get()
+}
+
+// InstanceName returns the current instance's name.
+func InstanceName() (string, error) {
+	return instName.get()
+}
+
+// Hostname returns the current instance's fully-qualified domain name.
+func Hostname() (string, error) {
+	return instHostname.get()
+}
+
+// Zone returns the current instance's zone, such as "us-central1-a".
+func Zone() (string, error) {
+	// The metadata service returns the full resource name, e.g.
+	// "projects/123456789/zones/us-central1-a".
+	full, err := instZone.get()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(full, "/")
+	return parts[len(parts)-1], nil
+}
+
+// NumericProjectID returns the current instance's numeric project ID.
+func NumericProjectID() (string, error) {
+	return numericProjID.get()
+}
+
+// InternalIP returns the instance's primary internal IP address.
+func InternalIP() (string, error) {
+	return MetadataValue("instance/network-interfaces/0/ip")
+}
+
+// ExternalIP returns the instance's primary external (public) IP
+// address, if it has one.
+func ExternalIP() (string, error) {
+	return MetadataValue("instance/network-interfaces/0/access-configs/0/external-ip")
+}
+
+// Tags returns the list of user-defined instance tags.
+func Tags() ([]string, error) {
+	val, err := MetadataValue("instance/tags")
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	if err := json.Unmarshal([]byte(val), &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Scopes returns the list of OAuth2 scopes granted to serviceAccount,
+// which may be empty to mean the default service account.
+func Scopes(serviceAccount string) ([]string, error) {
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return lines("instance/service-accounts/" + serviceAccount + "/scopes")
+}
+
+// InstanceAttributes returns the keys of the instance's custom
+// metadata attributes.
+func InstanceAttributes() ([]string, error) {
+	return lines("instance/attributes/")
+}
+
+// InstanceAttributeValue returns the value of the instance attribute
+// with the provided key.
+func InstanceAttributeValue(key string) (string, error) {
+	return MetadataValue("instance/attributes/" + key)
+}
+
+// ProjectAttributes returns the keys of the project's custom metadata
+// attributes.
+func ProjectAttributes() ([]string, error) {
+	return lines("project/attributes/")
+}
+
+// ProjectAttributeValue returns the value of the project attribute
+// with the provided key.
+func ProjectAttributeValue(key string) (string, error) {
+	return MetadataValue("project/attributes/" + key)
+}
+
+// lines fetches suffix and splits its trimmed response body on
+// newlines, the format the metadata service uses for its directory
+// listings (scopes, attribute keys, ...).
+func lines(suffix string) ([]string, error) {
+	val, err := MetadataValue(suffix)
+	if err != nil {
+		return nil, err
+	}
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return nil, nil
+	}
+	return strings.Split(val, "\n"), nil
+}
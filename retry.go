@@ -0,0 +1,136 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryConfig controls how metadata GETs are retried on transient
+// failure. The zero value makes a single attempt with no retries; use
+// defaultRetryConfig or a copy of it as a starting point.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of times to try a request,
+	// including the first attempt.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. Subsequent
+	// retries grow by Multiplier up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// defaultRetryConfig is used by MetadataValue and MetadataValueContext,
+// and is the starting point for transports that don't override the
+// retry policy via WithRetryConfig.
+var defaultRetryConfig = RetryConfig{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// fetchMetadata fetches suffix from the metadata service, retrying on
+// connection errors and 500/502/503/504 responses according to retry.
+// It gives up as soon as ctx is done.
+func fetchMetadata(ctx context.Context, suffix string, retry RetryConfig) (string, error) {
+	url := "http://" + metadataHost() + "/computeMetadata/v1/" + suffix
+
+	attempts := retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	backoff := retry.InitialBackoff
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(jitter(backoff)):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			backoff = nextBackoff(backoff, retry)
+		}
+		val, retryable, err := doMetadataRequest(ctx, url)
+		if err == nil {
+			return val, nil
+		}
+		lastErr = err
+		if !retryable {
+			return "", err
+		}
+	}
+	return "", lastErr
+}
+
+// doMetadataRequest performs a single metadata GET and reports whether
+// the error, if any, is worth retrying.
+func doMetadataRequest(ctx context.Context, url string) (value string, retryable bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Connection errors (including ctx deadlines surfaced by the
+		// transport) are always worth a retry; fetchMetadata bails out
+		// immediately once ctx is actually done.
+		return "", true, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", isRetryableStatus(res.StatusCode), fmt.Errorf("status code %d trying to fetch %s", res.StatusCode, url)
+	}
+	all, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", true, err
+	}
+	return string(all), false, nil
+}
+
+// nextBackoff grows backoff by retry.Multiplier, capped at
+// retry.MaxBackoff. The multiplication happens in floating point
+// before converting back to a Duration, since Multiplier is commonly
+// fractional (e.g. 1.5) and a Duration(retry.Multiplier) conversion
+// would truncate any value below 2 to zero nanoseconds.
+func nextBackoff(backoff time.Duration, retry RetryConfig) time.Duration {
+	backoff = time.Duration(float64(backoff) * retry.Multiplier)
+	if backoff > retry.MaxBackoff {
+		backoff = retry.MaxBackoff
+	}
+	return backoff
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// jitter returns a random duration in [d/2, d], a.k.a. "half jitter",
+// so that concurrently backing-off callers don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
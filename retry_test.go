@@ -0,0 +1,68 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNextBackoffFractionalMultiplier(t *testing.T) {
+	retry := RetryConfig{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     1.5,
+	}
+	backoff := retry.InitialBackoff
+	want := []time.Duration{150 * time.Millisecond, 225 * time.Millisecond, 337500 * time.Microsecond}
+	for i, w := range want {
+		backoff = nextBackoff(backoff, retry)
+		if backoff != w {
+			t.Fatalf("backoff after growth %d = %v, want %v", i+1, backoff, w)
+		}
+	}
+}
+
+func TestNextBackoffCapsAtMax(t *testing.T) {
+	retry := RetryConfig{MaxBackoff: 500 * time.Millisecond, Multiplier: 2}
+	if got := nextBackoff(400*time.Millisecond, retry); got != retry.MaxBackoff {
+		t.Fatalf("nextBackoff() = %v, want capped at %v", got, retry.MaxBackoff)
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	retryable := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	for _, code := range retryable {
+		if !isRetryableStatus(code) {
+			t.Errorf("isRetryableStatus(%d) = false, want true", code)
+		}
+	}
+	notRetryable := []int{http.StatusOK, http.StatusNotFound, http.StatusForbidden, http.StatusBadRequest}
+	for _, code := range notRetryable {
+		if isRetryableStatus(code) {
+			t.Errorf("isRetryableStatus(%d) = true, want false", code)
+		}
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	d := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < d/2 || got > d {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v]", d, got, d/2, d)
+		}
+	}
+	if got := jitter(0); got != 0 {
+		t.Fatalf("jitter(0) = %v, want 0", got)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Subscribe calls fn with the current value of the metadata suffix,
+// and again every time that value changes, until fn returns an error
+// or ctx is done. Rather than poll, it uses the metadata service's
+// hanging-GET mechanism (wait_for_change=true&last_etag=...), so
+// Subscribe only wakes up when there's actually something new to
+// report. This is the standard way to react to instance-attribute
+// edits, such as rolling config changes, without polling.
+//
+// The first call to fn seeds it with suffix's value at subscription
+// time. If suffix does not exist, fn is called once with ok=false and
+// Subscribe returns the result of that call.
+func Subscribe(ctx context.Context, suffix string, fn func(value string, ok bool) error) error {
+	var etag string
+	for first := true; ; first = false {
+		url := suffix
+		if !first {
+			sep := "?"
+			if strings.Contains(url, "?") {
+				sep = "&"
+			}
+			url += sep + "wait_for_change=true&last_etag=" + etag
+		}
+		val, newEtag, status, err := fetchETag(ctx, url)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusNotFound {
+			return fn("", false)
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("status code %d trying to fetch %s", status, url)
+		}
+		etag = newEtag
+		if err := fn(val, true); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchETag is like fetchMetadata but returns the raw status code and
+// the response's ETag header instead of treating non-200 as an error,
+// since Subscribe needs to tell a 404 apart from a real failure.
+func fetchETag(ctx context.Context, suffix string) (value, etag string, status int, err error) {
+	url := "http://" + metadataHost() + "/computeMetadata/v1/" + suffix
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer res.Body.Close()
+	all, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return string(all), res.Header.Get("Etag"), res.StatusCode, nil
+}
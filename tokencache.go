@@ -0,0 +1,129 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenRefresher fetches a fresh access token along with the time it
+// was issued and when it expires.
+type tokenRefresher func(ctx context.Context) (token string, issued, expires time.Time, err error)
+
+// tokenCache caches a single access token and refreshes it on demand.
+// Only one goroutine performs an actual refresh at a time
+// (singleflight); concurrent callers wait on the in-flight refresh
+// instead of each triggering their own. Once the cached token is
+// within refreshAhead of its expiry, a background refresh is started
+// so that callers keep getting the still-valid cached token instead of
+// blocking on the network. It's shared by the native GCE transport and
+// the workload-identity-federation transport so both get the same
+// refresh behavior.
+type tokenCache struct {
+	refresh      tokenRefresher
+	refreshAhead float64
+
+	mu         sync.Mutex
+	token      string
+	issued     time.Time
+	expires    time.Time
+	refreshErr error
+	refreshing chan struct{}
+}
+
+func newTokenCache(refreshAhead float64, refresh tokenRefresher) *tokenCache {
+	return &tokenCache{refresh: refresh, refreshAhead: refreshAhead}
+}
+
+func (c *tokenCache) get(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if c.validLocked() {
+		tok := c.token
+		if c.shouldRefreshAheadLocked() && c.refreshing == nil {
+			c.startRefreshLocked()
+		}
+		c.mu.Unlock()
+		return tok, nil
+	}
+	if c.refreshing == nil {
+		c.startRefreshLocked()
+	}
+	ch := c.refreshing
+	c.mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	c.mu.Lock()
+	tok, err := c.token, c.refreshErr
+	c.mu.Unlock()
+	if tok == "" {
+		return "", err
+	}
+	return tok, nil
+}
+
+// validLocked reports whether the cached token is still usable. c.mu
+// must be held.
+func (c *tokenCache) validLocked() bool {
+	return c.token != "" && c.expires.After(time.Now().Add(2*time.Second))
+}
+
+// shouldRefreshAheadLocked reports whether the cached token has
+// entered its refresh-ahead window. c.mu must be held.
+func (c *tokenCache) shouldRefreshAheadLocked() bool {
+	ttl := c.expires.Sub(c.issued)
+	if ttl <= 0 {
+		return false
+	}
+	return time.Until(c.expires) < time.Duration(float64(ttl)*c.refreshAhead)
+}
+
+// startRefreshLocked launches a goroutine that fetches a fresh token
+// and wakes up anyone waiting on the channel it stores in c.refreshing
+// by closing it once the result is applied. c.mu must be
+// held; it is released and re-acquired by the goroutine.
+func (c *tokenCache) startRefreshLocked() {
+	ch := make(chan struct{})
+	c.refreshing = ch
+	go func() {
+		token, issued, expires, err := c.refresh(context.Background())
+		c.mu.Lock()
+		if err == nil {
+			c.token = token
+			c.issued = issued
+			c.expires = expires
+			c.refreshErr = nil
+		} else {
+			c.refreshErr = err
+			// Only clear the cached token if it's no longer valid. A
+			// refresh-ahead attempt can fail while the existing token is
+			// still perfectly good; in that case leave it in place so
+			// callers keep getting it instead of being forced to block on
+			// a synchronous refresh, and let the refresh-ahead window
+			// retry on the next call. A blocking refresh, by contrast,
+			// only ever starts when the token was already invalid, so
+			// this still clears it in that case.
+			if !c.validLocked() {
+				c.token = ""
+				c.expires = time.Time{}
+			}
+		}
+		c.refreshing = nil
+		c.mu.Unlock()
+		close(ch)
+	}()
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2014 Google & the Go AUTHORS
+
+Go AUTHORS are:
+See https://code.google.com/p/go/source/browse/AUTHORS
+
+Licensed under the terms of Go itself:
+https://code.google.com/p/go/source/browse/LICENSE
+*/
+
+package gce
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheFailedRefreshClearsStaleToken(t *testing.T) {
+	refreshErr := errors.New("refresh failed")
+	c := newTokenCache(0, func(ctx context.Context) (string, time.Time, time.Time, error) {
+		return "", time.Time{}, time.Time{}, refreshErr
+	})
+	// Seed an already-expired token, as if an earlier refresh had
+	// succeeded and time has since passed.
+	c.token = "first-token"
+	c.issued = time.Now().Add(-time.Hour)
+	c.expires = time.Now().Add(-time.Minute)
+
+	tok, err := c.get(context.Background())
+	if tok != "" {
+		t.Errorf("get() token = %q, want empty on failed refresh", tok)
+	}
+	if !errors.Is(err, refreshErr) {
+		t.Errorf("get() err = %v, want %v", err, refreshErr)
+	}
+}
+
+func TestTokenCacheFailedBackgroundRefreshKeepsValidToken(t *testing.T) {
+	refreshErr := errors.New("refresh-ahead failed")
+	attempted := make(chan struct{}, 1)
+	c := newTokenCache(0.5, func(ctx context.Context) (string, time.Time, time.Time, error) {
+		select {
+		case attempted <- struct{}{}:
+		default:
+		}
+		return "", time.Time{}, time.Time{}, refreshErr
+	})
+	// Still good for 2 more minutes out of a 10-minute TTL: well inside
+	// the 50% refresh-ahead window, but not actually expired.
+	c.token = "still-good"
+	c.issued = time.Now().Add(-8 * time.Minute)
+	c.expires = time.Now().Add(2 * time.Minute)
+	wantExpires := c.expires
+
+	tok, err := c.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if tok != "still-good" {
+		t.Fatalf("get() = %q, want the still-valid cached token", tok)
+	}
+
+	select {
+	case <-attempted:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh was not attempted")
+	}
+
+	// Give the background goroutine a moment to apply its result, then
+	// confirm a later call still gets the cached token synchronously
+	// instead of blocking on (and failing) a synchronous refresh.
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	gotToken, gotExpires := c.token, c.expires
+	c.mu.Unlock()
+	if gotToken != "still-good" {
+		t.Errorf("after failed background refresh, token = %q, want %q", gotToken, "still-good")
+	}
+	if !gotExpires.Equal(wantExpires) {
+		t.Errorf("after failed background refresh, expires = %v, want unchanged %v", gotExpires, wantExpires)
+	}
+
+	tok, err = c.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() after failed background refresh error = %v", err)
+	}
+	if tok != "still-good" {
+		t.Errorf("get() after failed background refresh = %q, want %q", tok, "still-good")
+	}
+}
+
+func TestTokenCacheServesValidTokenWithoutRefreshing(t *testing.T) {
+	calls := 0
+	c := newTokenCache(0, func(ctx context.Context) (string, time.Time, time.Time, error) {
+		calls++
+		return "new-token", time.Now(), time.Now().Add(time.Hour), nil
+	})
+	c.token = "cached-token"
+	c.issued = time.Now().Add(-time.Minute)
+	c.expires = time.Now().Add(time.Hour)
+
+	tok, err := c.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if tok != "cached-token" {
+		t.Errorf("get() = %q, want %q", tok, "cached-token")
+	}
+	if calls != 0 {
+		t.Errorf("refresh called %d times, want 0", calls)
+	}
+}
+
+func TestTokenCacheRefreshesOnceForConcurrentCallers(t *testing.T) {
+	calls := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := newTokenCache(0, func(ctx context.Context) (string, time.Time, time.Time, error) {
+		calls++
+		close(started)
+		<-release
+		return "fresh-token", time.Now(), time.Now().Add(time.Hour), nil
+	})
+
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			tok, err := c.get(context.Background())
+			if err != nil {
+				t.Errorf("get() error = %v", err)
+			}
+			results <- tok
+		}()
+	}
+
+	<-started
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if got := <-results; got != "fresh-token" {
+			t.Errorf("get() = %q, want %q", got, "fresh-token")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("refresh called %d times, want 1 (singleflight)", calls)
+	}
+}
+
+func TestTokenCacheBackgroundRefreshAhead(t *testing.T) {
+	refreshed := make(chan struct{}, 1)
+	c := newTokenCache(0.5, func(ctx context.Context) (string, time.Time, time.Time, error) {
+		select {
+		case refreshed <- struct{}{}:
+		default:
+		}
+		return "refreshed-token", time.Now(), time.Now().Add(time.Hour), nil
+	})
+	// Issued 50 minutes ago with a 1-hour TTL and only 10 minutes left:
+	// well within the 50% refresh-ahead window.
+	c.token = "about-to-expire"
+	c.issued = time.Now().Add(-50 * time.Minute)
+	c.expires = time.Now().Add(10 * time.Minute)
+
+	tok, err := c.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if tok != "about-to-expire" {
+		t.Errorf("get() = %q, want the still-valid cached token", tok)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh was not started")
+	}
+}